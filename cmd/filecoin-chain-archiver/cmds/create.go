@@ -19,19 +19,28 @@ import (
 	"github.com/filecoin-project/filecoin-chain-archiver/pkg/config"
 	"github.com/filecoin-project/filecoin-chain-archiver/pkg/consensus"
 	"github.com/filecoin-project/filecoin-chain-archiver/pkg/export"
+	"github.com/filecoin-project/filecoin-chain-archiver/pkg/export/compress"
 	"github.com/filecoin-project/filecoin-chain-archiver/pkg/nodelocker/client"
+	"github.com/filecoin-project/filecoin-chain-archiver/pkg/notify"
+	"github.com/filecoin-project/filecoin-chain-archiver/pkg/preflight"
+	"github.com/filecoin-project/filecoin-chain-archiver/pkg/upload"
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	tags2 "github.com/minio/minio-go/v7/pkg/tags"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/lotus/api"
 )
 
-func Compress(in io.Reader, out io.Writer) error {
-	enc, err := zstd.NewWriter(out)
+// defaultFormats is used when the "formats" flag is left unset.
+var defaultFormats = []string{"zstd"}
+
+// CompressWith copies in to out through the given codec's writer.
+func CompressWith(codec compress.Codec, in io.Reader, out io.Writer) error {
+	enc, err := codec.NewWriter(out)
 	if err != nil {
 		return err
 	}
@@ -44,11 +53,16 @@ func Compress(in io.Reader, out io.Writer) error {
 }
 
 type snapshotInfo struct {
+	codec          compress.Codec
 	digest         string
 	size           int64
 	filename       string
 	latestIndex    string
 	latestLocation string
+	// verified is set once VerifyObject confirms the uploaded object's
+	// digest, so a corrupted or partial upload is neither promoted to
+	// latest nor advertised to webhooks.
+	verified bool
 }
 
 type snapshotReader struct {
@@ -195,6 +209,68 @@ var cmdCreate = &cli.Command{
 			Usage:   "directory where to save the exported CAR file",
 			EnvVars: []string{"FCA_EXPORT_DIR"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "formats",
+			Usage:   "compression formats to produce and upload, comma separated (available: " + strings.Join(compress.Names(), ", ") + ")",
+			EnvVars: []string{"FCA_CREATE_FORMATS"},
+			Value:   cli.NewStringSlice(defaultFormats...),
+		},
+		&cli.StringFlag{
+			Name:    "sse-c-key-file",
+			Usage:   "path to a file containing a 32 byte key to encrypt uploaded objects with SSE-C",
+			EnvVars: []string{"FCA_CREATE_SSE_C_KEY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "sse-kms-key-id",
+			Usage:   "KMS key id to encrypt uploaded objects with SSE-KMS",
+			EnvVars: []string{"FCA_CREATE_SSE_KMS_KEY_ID"},
+		},
+		&cli.IntFlag{
+			Name:    "upload-part-size",
+			Usage:   "size in bytes of each multipart upload part",
+			EnvVars: []string{"FCA_CREATE_UPLOAD_PART_SIZE"},
+			Value:   256 << 20,
+		},
+		&cli.IntFlag{
+			Name:    "upload-concurrency",
+			Usage:   "number of multipart upload parts to upload concurrently, per format",
+			EnvVars: []string{"FCA_CREATE_UPLOAD_CONCURRENCY"},
+			Value:   4,
+		},
+		&cli.StringFlag{
+			Name:    "upload-state-dir",
+			Usage:   "directory to persist in-progress multipart upload state, for resuming after a failure",
+			EnvVars: []string{"FCA_CREATE_UPLOAD_STATE_DIR"},
+			Value:   os.TempDir(),
+		},
+		&cli.DurationFlag{
+			Name:    "upload-deadline",
+			Usage:   "abort the upload if it has not completed within this duration of starting, 0 for no deadline",
+			EnvVars: []string{"FCA_CREATE_UPLOAD_DEADLINE"},
+		},
+		&cli.StringFlag{
+			Name:    "history-file",
+			Usage:   "path to a local file recording the last successful snapshot size, used for the free space preflight check. Defaults to a file in export-dir",
+			EnvVars: []string{"FCA_CREATE_HISTORY_FILE"},
+		},
+		&cli.Float64Flag{
+			Name:    "free-space-safety-factor",
+			Usage:   "refuse to start unless export-dir has at least this multiple of the last snapshot's size free",
+			EnvVars: []string{"FCA_CREATE_FREE_SPACE_SAFETY_FACTOR"},
+			Value:   1.2,
+		},
+		&cli.IntFlag{
+			Name:    "verify-part-size",
+			Usage:   "size in bytes of each range request used to verify an uploaded object",
+			EnvVars: []string{"FCA_CREATE_VERIFY_PART_SIZE"},
+			Value:   256 << 20,
+		},
+		&cli.IntFlag{
+			Name:    "verify-concurrency",
+			Usage:   "number of range requests to issue concurrently when verifying an uploaded object",
+			EnvVars: []string{"FCA_CREATE_VERIFY_CONCURRENCY"},
+			Value:   4,
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		ctx := context.Background()
@@ -216,6 +292,49 @@ var cmdCreate = &cli.Command{
 		flagStaterootCount := cctx.Int("stateroot-count")
 		flagExportDir := cctx.String("export-dir")
 		flagFileName := cctx.String("filename")
+		flagFormats := cctx.StringSlice("formats")
+		flagSSECKeyFile := cctx.String("sse-c-key-file")
+		flagSSEKMSKeyID := cctx.String("sse-kms-key-id")
+		flagUploadPartSize := int64(cctx.Int("upload-part-size"))
+		flagUploadConcurrency := cctx.Int("upload-concurrency")
+		flagUploadStateDir := cctx.String("upload-state-dir")
+		flagUploadDeadline := cctx.Duration("upload-deadline")
+		flagHistoryFile := cctx.String("history-file")
+		flagFreeSpaceSafetyFactor := cctx.Float64("free-space-safety-factor")
+		flagVerifyPartSize := int64(cctx.Int("verify-part-size"))
+		flagVerifyConcurrency := cctx.Int("verify-concurrency")
+
+		if flagHistoryFile == "" {
+			flagHistoryFile = filepath.Join(flagExportDir, ".snapshot-history.json")
+		}
+
+		var uploadDeadline time.Time
+		if flagUploadDeadline > 0 {
+			uploadDeadline = time.Now().Add(flagUploadDeadline)
+		}
+
+		lastSnapshotSize, err := preflight.LastSnapshotSize(flagHistoryFile)
+		if err != nil {
+			return err
+		}
+
+		if err := preflight.CheckFreeSpace(flagExportDir, lastSnapshotSize, flagFreeSpaceSafetyFactor); err != nil {
+			return err
+		}
+
+		sse, err := resolveServerSideEncryption(flagSSECKeyFile, flagSSEKMSKeyID)
+		if err != nil {
+			return err
+		}
+
+		codecs := make([]compress.Codec, 0, len(flagFormats))
+		for _, name := range flagFormats {
+			codec, err := compress.Get(name)
+			if err != nil {
+				return err
+			}
+			codecs = append(codecs, codec)
+		}
 
 		u, err := url.Parse(flagBucketEndpoint)
 		if err != nil {
@@ -273,6 +392,8 @@ var cmdCreate = &cli.Command{
 			return err
 		}
 
+		genesisCid := gtp.Cids()[0].String()
+
 		now := time.Now()
 		expected := export.GetExpectedHeightAt(gtp, now, 30*time.Second)
 
@@ -313,6 +434,7 @@ var cmdCreate = &cli.Command{
 			return err
 		}
 
+		// Also serves as the preflight check that the nodelocker is reachable.
 		filterList, err := nl.LockedPeers(ctx)
 		if err != nil {
 			return err
@@ -344,18 +466,62 @@ var cmdCreate = &cli.Command{
 			return xerrors.Errorf("failed to aquire lock")
 		}
 
+		var minioClient *minio.Client
+		if !flagDiscard {
+			host := u.Hostname()
+			port := u.Port()
+			if port == "" {
+				port = "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+			}
+
+			logger.Infow("upload endpoint", "host", host, "port", port, "tls", u.Scheme == "https")
+
+			minioClient, err = minio.New(fmt.Sprintf("%s:%s", host, port), &minio.Options{
+				Creds:  credentials.NewStaticV4(flagBucketAccessKey, flagBucketSecretKey, ""),
+				Secure: u.Scheme == "https",
+			})
+			if err != nil {
+				return err
+			}
+
+			// Verified before starting the export, so bad credentials, a wrong
+			// region, or missing write permissions are caught before a
+			// multi-hour, multi-hundred-GB export is wasted.
+			if err := preflight.CheckBucket(ctx, minioClient, flagBucket); err != nil {
+				return err
+			}
+		}
+
+		// g is the top-level errgroup for the job: export, lock renewal, and
+		// compression/upload all run under it so a permanent failure in any
+		// one of them cancels the rest instead of leaking goroutines.
+		g, ctxGroup := errgroup.WithContext(ctx)
+
 		e := export.NewExport(node, headTs, tailTs, flagFileName, flagExportDir)
 		errCh := make(chan error)
-		go func() {
-			errCh <- e.Export(ctx)
-		}()
+		// exportDone is closed (not sent on) when the export finishes, so it
+		// can broadcast completion to every goroutine that needs to know,
+		// unlike errCh, which is consumed exactly once, by the snapshotReader.
+		exportDone := make(chan struct{})
+		g.Go(func() error {
+			err := e.Export(ctxGroup)
+			errCh <- err
+			close(exportDone)
+			return err
+		})
 
-		go func() {
-			lock := lock
+		g.Go(func() error {
 			for {
 				select {
+				case <-ctxGroup.Done():
+					return nil
+				case <-exportDone:
+					return nil
 				case <-time.After(time.Until(lock.Expiry()) / 2):
-					locked, err := lock.Renew(ctx)
+					locked, err := lock.Renew(ctxGroup)
 					if err != nil {
 						logger.Errorw("error updating lock", "err", err)
 						continue
@@ -369,7 +535,7 @@ var cmdCreate = &cli.Command{
 					logger.Debugw("lock aquired", "expiry", lock.Expiry())
 				}
 			}
-		}()
+		})
 
 		rrPath := filepath.Join(flagExportDir, flagFileName)
 		for {
@@ -391,10 +557,12 @@ var cmdCreate = &cli.Command{
 		defer f.Close()
 		rr := newSnapshotReader(f, errCh)
 
-		go func() {
+		g.Go(func() error {
 			var lastSize int64
 			for {
 				select {
+				case <-ctxGroup.Done():
+					return nil
 				case <-time.After(flagProgressUpdate):
 					size := e.Progress(rrPath)
 					if size == 0 {
@@ -402,67 +570,62 @@ var cmdCreate = &cli.Command{
 					}
 					logger.Infow("update", "total", size, "speed", (size-lastSize)/int64(flagProgressUpdate/time.Second))
 					lastSize = size
-				case err := <-errCh:
-					if err != nil {
-						break
-					}
+				case <-exportDone:
+					return nil
 				}
 			}
-		}()
+		})
 
+		var sis []*snapshotInfo
 		if flagDiscard {
-			logger.Infow("discarding output")
-			g, ctxGroup := errgroup.WithContext(ctx)
-			g.Go(func() error {
-				return runWriteCompressed(ctxGroup, rrPath+".zstd", rr)
-			})
-			if err := g.Wait(); err != nil {
-				return err
-			}
-
-			if err := <-errCh; err != nil {
-				return err
-			}
-		} else {
-			host := u.Hostname()
-			port := u.Port()
-			if port == "" {
-				port = "80"
-				if u.Scheme == "https" {
-					port = "443"
-				}
+			logger.Infow("discarding output", "formats", flagFormats)
+			sources := teeReaders(rr, len(codecs))
+			for i, codec := range codecs {
+				codec, source := codec, sources[i]
+				g.Go(func() error {
+					return runWriteCompressed(ctxGroup, rrPath+codec.Extension(), codec, source)
+				})
 			}
+		}
 
-			logger.Infow("upload endpoint", "host", host, "port", port, "tls", u.Scheme == "https")
-
-			minioClient, err := minio.New(fmt.Sprintf("%s:%s", host, port), &minio.Options{
-				Creds:  credentials.NewStaticV4(flagBucketAccessKey, flagBucketSecretKey, ""),
-				Secure: u.Scheme == "https",
-			})
-			if err != nil {
-				return err
+		if !flagDiscard {
+			logger.Infow("object", "name", flagFileName, "formats", flagFormats)
+
+			sis = make([]*snapshotInfo, len(codecs))
+			sources := teeReaders(rr, len(codecs))
+			for i, codec := range codecs {
+				i, codec, source := i, codec, sources[i]
+				g.Go(func() error {
+					tags := map[string]string{
+						"height":            fmt.Sprintf("%d", height),
+						"confidence_height": fmt.Sprintf("%d", confidenceHeight),
+						"peer_id":           peerID,
+						"codec":             codec.Name(),
+						"genesis_cid":       genesisCid,
+						"stateroot_count":   fmt.Sprintf("%d", flagStaterootCount),
+						snapshotKindTag:     snapshotKindValue,
+					}
+					si, err := runUploadCompressed(ctxGroup, minioClient, flagBucket, flagNamePrefix, flagRetrievalEndpointPrefix, flagFileName+codec.Extension(), codec, peerID, height, bt, source, tags, sse, flagUploadPartSize, flagUploadConcurrency, flagUploadStateDir, uploadDeadline)
+					if err != nil {
+						return err
+					}
+					sis[i] = si
+					return nil
+				})
 			}
+		}
 
-			//t := export.TimeAtHeight(gtp, height, 30*time.Second)
-
-			logger.Infow("object", "name", flagFileName)
+		if err := g.Wait(); err != nil {
+			return err
+		}
 
-			g, ctxGroup := errgroup.WithContext(ctx)
-			var siCompressed *snapshotInfo
-			g.Go(func() error {
-				var err error
-				siCompressed, err = runUploadCompressed(ctxGroup, minioClient, flagBucket, flagNamePrefix, flagRetrievalEndpointPrefix, flagFileName+".zstd", peerID, bt, rr)
-				return err
-			})
-			if err := g.Wait(); err != nil {
-				return err
-			}
-			if err := <-errCh; err != nil {
-				return err
+		if exportInfo, statErr := os.Stat(rrPath); statErr == nil {
+			if err := preflight.RecordSnapshotSize(flagHistoryFile, exportInfo.Size()); err != nil {
+				logger.Errorw("failed to record snapshot history", "err", err)
 			}
+		}
 
-			sis := []*snapshotInfo{siCompressed}
-
+		if !flagDiscard {
 			var sb strings.Builder
 			for _, x := range sis {
 				fmt.Fprintf(&sb, "%s *%s\n", x.digest, x.filename)
@@ -479,6 +642,13 @@ var cmdCreate = &cli.Command{
 			}
 
 			for _, x := range sis {
+				key := fmt.Sprintf("%s%s", flagNamePrefix, x.filename)
+				if err := preflight.VerifyObject(ctx, minioClient, flagBucket, key, x.digest, flagVerifyPartSize, flagVerifyConcurrency, sse); err != nil {
+					logger.Errorw("uploaded object failed verification, not promoting to latest", "object", key, "err", err)
+					continue
+				}
+				x.verified = true
+
 				info, err := minioClient.PutObject(ctx, flagBucket, fmt.Sprintf("%s%s", flagNamePrefix, x.latestIndex), strings.NewReader(x.latestLocation), -1, minio.PutObjectOptions{
 					ContentType: "text/plain",
 				})
@@ -497,6 +667,34 @@ var cmdCreate = &cli.Command{
 					"expiration_rule_id", info.ExpirationRuleID,
 				)
 			}
+
+			elapsed := int64(time.Since(bt).Round(time.Second).Seconds())
+			for _, x := range sis {
+				if !x.verified {
+					logger.Warnw("skipping webhook notification for unverified snapshot", "object", flagNamePrefix+x.filename)
+					continue
+				}
+
+				retrievalURL, err := url.JoinPath(flagRetrievalEndpointPrefix, flagNamePrefix+x.filename)
+				if err != nil {
+					logger.Errorw("failed to build retrieval url for notification", "err", err)
+					continue
+				}
+
+				notify.NotifyAll(ctx, cfg.Webhooks, notify.Payload{
+					Height:           int64(height),
+					ConfidenceHeight: int64(confidenceHeight),
+					GenesisCid:       genesisCid,
+					Digest:           x.digest,
+					Size:             x.size,
+					Codec:            x.codec.Name(),
+					Bucket:           flagBucket,
+					Key:              flagNamePrefix + x.filename,
+					RetrievalURL:     retrievalURL,
+					PeerID:           peerID,
+					ElapsedSeconds:   elapsed,
+				})
+			}
 		}
 
 		logger.Infow("snapshot job finished", "elapsed", int64(time.Since(bt).Round(time.Second).Seconds()), "peer", peerID)
@@ -505,21 +703,44 @@ var cmdCreate = &cli.Command{
 	},
 }
 
-func compress(source io.Reader) io.Reader {
+// teeReaders reads r once and returns n readers which each replay every byte
+// read from r, so a single pass over the CAR stream can feed several
+// concurrent compressors.
+func teeReaders(r io.Reader, n int) []io.Reader {
+	pw := make([]*io.PipeWriter, n)
+	writers := make([]io.Writer, n)
+	readers := make([]io.Reader, n)
+	for i := range pw {
+		pr, w := io.Pipe()
+		pw[i] = w
+		writers[i] = w
+		readers[i] = pr
+	}
+
+	go func() {
+		_, err := io.Copy(io.MultiWriter(writers...), r)
+		for _, w := range pw {
+			w.CloseWithError(err)
+		}
+	}()
+
+	return readers
+}
+
+func compressWith(codec compress.Codec, source io.Reader) io.Reader {
 	r, w := io.Pipe()
 	go func() {
-		Compress(source, w)
-		w.Close()
+		w.CloseWithError(CompressWith(codec, source, w))
 	}()
 	return r
 }
 
-func runWriteCompressed(ctx context.Context, path string, source io.Reader) error {
+func runWriteCompressed(ctx context.Context, path string, codec compress.Codec, source io.Reader) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	r := compress(source)
+	r := compressWith(codec, source)
 	n, err := io.Copy(file, r)
 	if err != nil {
 		return err
@@ -528,50 +749,94 @@ func runWriteCompressed(ctx context.Context, path string, source io.Reader) erro
 	return nil
 }
 
-func runUploadCompressed(ctx context.Context, minioClient *minio.Client, flagBucket, flagNamePrefix, flagRetrievalEndpointPrefix, name, peerID string, bt time.Time, source io.Reader) (*snapshotInfo, error) {
-	r1 := compress(source)
+// resolveServerSideEncryption builds the server-side encryption to apply to
+// uploaded objects from the "sse-c-key-file" and "sse-kms-key-id" flags. At
+// most one of the two may be set.
+func resolveServerSideEncryption(sseCKeyFile, sseKMSKeyID string) (encrypt.ServerSide, error) {
+	switch {
+	case sseCKeyFile != "" && sseKMSKeyID != "":
+		return nil, xerrors.Errorf("sse-c-key-file and sse-kms-key-id are mutually exclusive")
+	case sseCKeyFile != "":
+		key, err := os.ReadFile(sseCKeyFile)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read sse-c-key-file: %w", err)
+		}
+		return encrypt.NewSSEC(key)
+	case sseKMSKeyID != "":
+		return encrypt.NewSSEKMS(sseKMSKeyID, nil)
+	default:
+		return nil, nil
+	}
+}
+
+func runUploadCompressed(ctx context.Context, minioClient *minio.Client, flagBucket, flagNamePrefix, flagRetrievalEndpointPrefix, name string, codec compress.Codec, peerID string, height abi.ChainEpoch, bt time.Time, source io.Reader, tags map[string]string, sse encrypt.ServerSide, partSize int64, concurrency int, stateDir string, deadline time.Time) (*snapshotInfo, error) {
+	r1 := compressWith(codec, source)
 
 	h := sha256.New()
 	r := io.TeeReader(r1, h)
 
 	filename := name
-
-	info, err := minioClient.PutObject(ctx, flagBucket, fmt.Sprintf("%s%s", flagNamePrefix, filename), r, -1, minio.PutObjectOptions{
-		ContentDisposition: fmt.Sprintf("attachment; filename=\"%s\"", filename),
-		ContentType:        "application/octet-stream",
+	key := fmt.Sprintf("%s%s", flagNamePrefix, filename)
+
+	coreClient := &minio.Core{Client: minioClient}
+	result, err := upload.Upload(ctx, coreClient, flagBucket, key, r, upload.Options{
+		PartSize:    partSize,
+		Concurrency: concurrency,
+		StateDir:    stateDir,
+		StateKey:    fmt.Sprintf("%d-%s-%s", height, peerID, codec.Name()),
+		Deadline:    deadline,
+		PutOptions: minio.PutObjectOptions{
+			ContentDisposition:   fmt.Sprintf("attachment; filename=\"%s\"", filename),
+			ContentType:          codec.MIME(),
+			ContentEncoding:      codec.ContentEncoding(),
+			UserTags:             tags,
+			ServerSideEncryption: sse,
+		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload object (%s): %w", fmt.Sprintf("%s%s", flagNamePrefix, filename), err)
+		return nil, fmt.Errorf("failed to upload object (%s): %w", key, err)
 	}
 
 	logger.Infow("compressed snapshot upload",
-		"bucket", info.Bucket,
-		"key", info.Key,
-		"etag", info.ETag,
-		"size", info.Size,
-		"location", info.Location,
-		"version_id", info.VersionID,
-		"expiration", info.Expiration,
-		"expiration_rule_id", info.ExpirationRuleID,
+		"bucket", flagBucket,
+		"key", key,
+		"etag", result.ETag,
+		"size", result.Size,
 	)
 
-	snapshotSize := info.Size
+	snapshotSize := result.Size
 
-	latestLocation, err := url.JoinPath(flagRetrievalEndpointPrefix, info.Key)
+	latestLocation, err := url.JoinPath(flagRetrievalEndpointPrefix, key)
 	if err != nil {
-		logger.Errorw("failed to join request path", "request_prefix", flagRetrievalEndpointPrefix, "key", info.Key)
+		logger.Errorw("failed to join request path", "request_prefix", flagRetrievalEndpointPrefix, "key", key)
 		return nil, fmt.Errorf("failed to join request path: %w", err)
 	}
 
 	digest := fmt.Sprintf("%x", h.Sum(nil))
 
-	logger.Infow("compressed snapshot job finished", "digiest", digest, "elapsed", int64(time.Since(bt).Round(time.Second).Seconds()), "size", snapshotSize, "peer", peerID)
+	// The digest can only be known once the stream has been fully read, so it
+	// is tagged onto the object after the fact rather than at upload time.
+	digestTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		digestTags[k] = v
+	}
+	digestTags["digest"] = digest
+
+	objectTags, err := tags2.MapToObjectTags(digestTags)
+	if err != nil {
+		logger.Errorw("failed to build digest tag set", "object", key, "err", err)
+	} else if err := minioClient.PutObjectTagging(ctx, flagBucket, key, objectTags, minio.PutObjectTaggingOptions{}); err != nil {
+		logger.Errorw("failed to tag object with digest", "object", key, "err", err)
+	}
+
+	logger.Infow("compressed snapshot job finished", "codec", codec.Name(), "digiest", digest, "elapsed", int64(time.Since(bt).Round(time.Second).Seconds()), "size", snapshotSize, "peer", peerID)
 
 	return &snapshotInfo{
+		codec:          codec,
 		digest:         digest,
 		size:           snapshotSize,
 		filename:       filename,
-		latestIndex:    "latest.zst",
+		latestIndex:    fmt.Sprintf("latest%s", codec.Extension()),
 		latestLocation: latestLocation,
 	}, nil
 }
@@ -0,0 +1,144 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// snapshotKindTag is the object tag used to identify snapshot objects that
+// are eligible for lifecycle management.
+const snapshotKindTag = "kind"
+
+// snapshotKindValue is the value of snapshotKindTag applied to snapshot objects.
+const snapshotKindValue = "snapshot"
+
+var cmdLifecycle = &cli.Command{
+	Name:  "lifecycle",
+	Usage: "install a bucket lifecycle policy to expire old snapshots",
+	Description: TrimDescription(`
+		Installs a bucket lifecycle rule that expires objects tagged 'kind=snapshot' after a configurable
+		number of days. If the bucket is versioned, noncurrent versions of those objects are also expired
+		after 'noncurrent-expire-days', while always keeping the 'keep-latest' most recent noncurrent versions
+		around regardless of age.
+	`),
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "bucket",
+			Usage:   "bucket name to apply the lifecycle policy to",
+			EnvVars: []string{"FCA_LIFECYCLE_BUCKET"},
+		},
+		&cli.StringFlag{
+			Name:    "bucket-endpoint",
+			Usage:   "bucket host and port",
+			EnvVars: []string{"FCA_LIFECYCLE_BUCKET_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "access-key",
+			Usage:   "access key for bucket",
+			EnvVars: []string{"FCA_LIFECYCLE_ACCESS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "secret-key",
+			Usage:   "secret key for bucket",
+			EnvVars: []string{"FCA_LIFECYCLE_SECRET_KEY"},
+		},
+		&cli.IntFlag{
+			Name:    "expire-days",
+			Usage:   "number of days after which a snapshot object is expired",
+			EnvVars: []string{"FCA_LIFECYCLE_EXPIRE_DAYS"},
+			Value:   30,
+		},
+		&cli.IntFlag{
+			Name:    "noncurrent-expire-days",
+			Usage:   "number of days after which a noncurrent snapshot object version is expired, if the bucket is versioned",
+			EnvVars: []string{"FCA_LIFECYCLE_NONCURRENT_EXPIRE_DAYS"},
+			Value:   30,
+		},
+		&cli.IntFlag{
+			Name:    "keep-latest",
+			Usage:   "number of newer noncurrent snapshot versions to always keep, regardless of noncurrent-expire-days, if the bucket is versioned",
+			EnvVars: []string{"FCA_LIFECYCLE_KEEP_LATEST"},
+			Value:   0,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx := context.Background()
+
+		flagBucket := cctx.String("bucket")
+		flagBucketEndpoint := cctx.String("bucket-endpoint")
+		flagAccessKey := cctx.String("access-key")
+		flagSecretKey := cctx.String("secret-key")
+		flagExpireDays := cctx.Int("expire-days")
+		flagNoncurrentExpireDays := cctx.Int("noncurrent-expire-days")
+		flagKeepLatest := cctx.Int("keep-latest")
+
+		if flagBucket == "" {
+			return xerrors.Errorf("bucket is required")
+		}
+
+		u, err := url.Parse(flagBucketEndpoint)
+		if err != nil {
+			return err
+		}
+
+		host := u.Hostname()
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+
+		minioClient, err := minio.New(fmt.Sprintf("%s:%s", host, port), &minio.Options{
+			Creds:  credentials.NewStaticV4(flagAccessKey, flagSecretKey, ""),
+			Secure: u.Scheme == "https",
+		})
+		if err != nil {
+			return err
+		}
+
+		cfg := lifecycle.NewConfiguration()
+		cfg.Rules = []lifecycle.Rule{
+			{
+				ID:     "expire-snapshots",
+				Status: "Enabled",
+				RuleFilter: lifecycle.Filter{
+					Tag: lifecycle.Tag{
+						Key:   snapshotKindTag,
+						Value: snapshotKindValue,
+					},
+				},
+				Expiration: lifecycle.Expiration{
+					Days: lifecycle.ExpirationDays(flagExpireDays),
+				},
+				NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{
+					NoncurrentDays:          lifecycle.ExpirationDays(flagNoncurrentExpireDays),
+					NewerNoncurrentVersions: flagKeepLatest,
+				},
+			},
+		}
+
+		if err := minioClient.SetBucketLifecycle(ctx, flagBucket, cfg); err != nil {
+			return xerrors.Errorf("failed to set bucket lifecycle: %w", err)
+		}
+
+		logger.Infow("lifecycle policy installed",
+			"bucket", flagBucket,
+			"expire_days", flagExpireDays,
+			"noncurrent_expire_days", flagNoncurrentExpireDays,
+			"keep_latest", flagKeepLatest,
+			"applied_at", time.Now(),
+		)
+
+		return nil
+	},
+}
@@ -0,0 +1,25 @@
+// Package config loads the TOML configuration consumed by
+// filecoin-chain-archiver commands.
+package config
+
+import (
+	"github.com/BurntSushi/toml"
+
+	"github.com/filecoin-project/filecoin-chain-archiver/pkg/notify"
+)
+
+// ExportWorkerConfig is the configuration consumed by the "create" command.
+type ExportWorkerConfig struct {
+	// Nodes is the list of lotus node multiaddrs to export from.
+	Nodes []string `toml:"nodes"`
+	// Webhooks are notified when a snapshot upload completes.
+	Webhooks []notify.Endpoint `toml:"webhooks"`
+}
+
+// FromFile reads and decodes the TOML file at path into cfg, returning cfg.
+func FromFile(path string, cfg interface{}) (interface{}, error) {
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,53 @@
+// Package compress provides a registry of streaming compression codecs used
+// when producing snapshot archives, so callers can select a format by name
+// instead of hardcoding a single implementation.
+package compress
+
+import (
+	"fmt"
+	"io"
+)
+
+// Codec describes a streaming compression format that can be applied to a
+// chain export.
+type Codec interface {
+	// Name is the codec identifier used on the command line and in object tags (e.g. "zstd").
+	Name() string
+	// Extension is the file extension appended to snapshot filenames, including the leading dot.
+	Extension() string
+	// MIME is the value to use for the uploaded object's Content-Type.
+	MIME() string
+	// ContentEncoding is the value to use for the uploaded object's Content-Encoding, if any.
+	ContentEncoding() string
+	// NewWriter wraps out with a writer that compresses everything written to it using this codec.
+	NewWriter(out io.Writer) (io.WriteCloser, error)
+}
+
+var registry = map[string]Codec{}
+
+// Register adds a codec to the registry under its Name. It panics if a codec
+// with the same name has already been registered.
+func Register(c Codec) {
+	if _, ok := registry[c.Name()]; ok {
+		panic(fmt.Sprintf("compress: codec already registered: %s", c.Name()))
+	}
+	registry[c.Name()] = c
+}
+
+// Get returns the codec registered under name.
+func Get(name string) (Codec, error) {
+	c, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec: %q (available: %v)", name, Names())
+	}
+	return c, nil
+}
+
+// Names returns the names of all registered codecs.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,21 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+func init() {
+	Register(gzipCodec{})
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string            { return "gzip" }
+func (gzipCodec) Extension() string       { return ".gz" }
+func (gzipCodec) MIME() string            { return "application/gzip" }
+func (gzipCodec) ContentEncoding() string { return "gzip" }
+
+func (gzipCodec) NewWriter(out io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(out, gzip.BestSpeed)
+}
@@ -0,0 +1,22 @@
+package compress
+
+import (
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+func init() {
+	Register(lz4Codec{})
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string            { return "lz4" }
+func (lz4Codec) Extension() string       { return ".lz4" }
+func (lz4Codec) MIME() string            { return "application/x-lz4" }
+func (lz4Codec) ContentEncoding() string { return "" }
+
+func (lz4Codec) NewWriter(out io.Writer) (io.WriteCloser, error) {
+	return lz4.NewWriter(out), nil
+}
@@ -0,0 +1,22 @@
+package compress
+
+import (
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	Register(xzCodec{})
+}
+
+type xzCodec struct{}
+
+func (xzCodec) Name() string            { return "xz" }
+func (xzCodec) Extension() string       { return ".xz" }
+func (xzCodec) MIME() string            { return "application/x-xz" }
+func (xzCodec) ContentEncoding() string { return "" }
+
+func (xzCodec) NewWriter(out io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(out)
+}
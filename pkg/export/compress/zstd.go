@@ -0,0 +1,22 @@
+package compress
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	Register(zstdCodec{})
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string            { return "zstd" }
+func (zstdCodec) Extension() string       { return ".zstd" }
+func (zstdCodec) MIME() string            { return "application/zstd" }
+func (zstdCodec) ContentEncoding() string { return "zstd" }
+
+func (zstdCodec) NewWriter(out io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(out)
+}
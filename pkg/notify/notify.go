@@ -0,0 +1,123 @@
+// Package notify posts snapshot completion events to configured webhook
+// endpoints so downstream consumers can react immediately instead of
+// polling the latest snapshot pointer.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var logger = logging.Logger("notify")
+
+// Endpoint is a single webhook destination, as declared in the TOML config.
+type Endpoint struct {
+	URL        string `toml:"url"`
+	AuthToken  string `toml:"auth_token"`
+	HMACSecret string `toml:"hmac_secret"`
+	MaxRetries int    `toml:"max_retries"`
+}
+
+// Payload is the JSON body POSTed to each endpoint when a snapshot completes.
+type Payload struct {
+	Height           int64  `json:"height"`
+	ConfidenceHeight int64  `json:"confidence_height"`
+	GenesisCid       string `json:"genesis_cid"`
+	Digest           string `json:"digest"`
+	Size             int64  `json:"size"`
+	Codec            string `json:"codec"`
+	Bucket           string `json:"bucket"`
+	Key              string `json:"key"`
+	RetrievalURL     string `json:"retrieval_url"`
+	PeerID           string `json:"peer_id"`
+	ElapsedSeconds   int64  `json:"elapsed"`
+}
+
+// defaultMaxRetries is used when an endpoint does not set max_retries.
+const defaultMaxRetries = 3
+
+// NotifyAll posts payload to every endpoint. A failure to notify one
+// endpoint does not stop delivery to the others, and is only logged, since a
+// notification failure must never fail the snapshot job itself.
+func NotifyAll(ctx context.Context, endpoints []Endpoint, payload Payload) {
+	for _, ep := range endpoints {
+		if err := notify(ctx, ep, payload); err != nil {
+			logger.Errorw("webhook notification failed", "url", ep.URL, "err", err)
+		}
+	}
+}
+
+func notify(ctx context.Context, ep Endpoint, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	maxAttempts := ep.MaxRetries
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+			jitter := time.Duration(rand.Int63n(int64(backoff)))
+			select {
+			case <-time.After(backoff + jitter):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err := send(ctx, ep, body); err != nil {
+			lastErr = err
+			logger.Warnw("webhook delivery failed, will retry", "url", ep.URL, "attempt", attempt+1, "err", err)
+			continue
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("failed after %d attempts: %w", maxAttempts, lastErr)
+}
+
+func send(ctx context.Context, ep Endpoint, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if ep.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ep.AuthToken)
+	}
+
+	if ep.HMACSecret != "" {
+		mac := hmac.New(sha256.New, []byte(ep.HMACSecret))
+		mac.Write(body)
+		req.Header.Set("X-FCA-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSendSetsAuthorizationHeader(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ep := Endpoint{URL: srv.URL, AuthToken: "secret-token"}
+	if err := send(context.Background(), ep, []byte(`{}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if want := "Bearer secret-token"; gotAuth != want {
+		t.Errorf("Authorization header = %q, want %q", gotAuth, want)
+	}
+}
+
+func TestSendOmitsAuthorizationHeaderWhenNoToken(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ep := Endpoint{URL: srv.URL}
+	if err := send(context.Background(), ep, []byte(`{}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if gotAuth != "" {
+		t.Errorf("Authorization header = %q, want empty", gotAuth)
+	}
+}
+
+func TestSendSetsHMACSignatureHeader(t *testing.T) {
+	var gotSig string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig = r.Header.Get("X-FCA-Signature")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ep := Endpoint{URL: srv.URL, HMACSecret: "shh"}
+	body := []byte(`{"height":1}`)
+	if err := send(context.Background(), ep, body); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// sha256=<64 hex chars>
+	if want := "sha256="; len(gotSig) != len(want)+64 || gotSig[:len(want)] != want {
+		t.Errorf("X-FCA-Signature header = %q, want prefix %q followed by 64 hex chars", gotSig, want)
+	}
+}
+
+func TestSendReturnsErrorOnNonSuccessStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	if err := send(context.Background(), Endpoint{URL: srv.URL}, []byte(`{}`)); err == nil {
+		t.Fatal("expected error for 500 response, got nil")
+	}
+}
+
+func TestNotifyRetriesUntilSuccess(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ep := Endpoint{URL: srv.URL, MaxRetries: 5}
+	if err := notify(context.Background(), ep, Payload{Height: 1}); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestNotifyGivesUpAfterMaxRetries(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ep := Endpoint{URL: srv.URL, MaxRetries: 2}
+	if err := notify(context.Background(), ep, Payload{}); err == nil {
+		t.Fatal("expected error after exhausting retries, got nil")
+	}
+
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestNotifyAllContinuesAfterOneEndpointFails(t *testing.T) {
+	var okCalled int32
+	badSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badSrv.Close()
+
+	okSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&okCalled, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer okSrv.Close()
+
+	endpoints := []Endpoint{
+		{URL: badSrv.URL, MaxRetries: 1},
+		{URL: okSrv.URL, MaxRetries: 1},
+	}
+
+	// NotifyAll must not panic or abort early when one endpoint fails.
+	NotifyAll(context.Background(), endpoints, Payload{Height: 42})
+
+	if okCalled != 1 {
+		t.Errorf("okSrv called %d times, want 1", okCalled)
+	}
+}
+
+func TestPayloadMarshalsExpectedFields(t *testing.T) {
+	p := Payload{
+		Height:           100,
+		ConfidenceHeight: 115,
+		GenesisCid:       "bafy...",
+		Digest:           "abc123",
+		Size:             1024,
+		Codec:            "zstd",
+		Bucket:           "bucket",
+		Key:              "key",
+		RetrievalURL:     "https://example.com/key",
+		PeerID:           "peer",
+		ElapsedSeconds:   60,
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	for _, field := range []string{"height", "confidence_height", "genesis_cid", "digest", "size", "codec", "bucket", "key", "retrieval_url", "peer_id", "elapsed"} {
+		if _, ok := m[field]; !ok {
+			t.Errorf("marshaled payload missing field %q", field)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Package preflight implements pre- and post-flight checks around a
+// snapshot job: verifying there is enough disk space and bucket access
+// before starting the export, and verifying the uploaded object's integrity
+// before it is advertised as the latest snapshot.
+package preflight
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+var logger = logging.Logger("preflight")
+
+// history is the local record of the last successful snapshot's size, used
+// to estimate how much free space the next export will need.
+type history struct {
+	LastSnapshotSize int64 `json:"last_snapshot_size"`
+}
+
+// LastSnapshotSize reads the last successful snapshot size recorded at path.
+// It returns 0 if no history file exists yet.
+func LastSnapshotSize(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var h history
+	if err := json.Unmarshal(b, &h); err != nil {
+		return 0, err
+	}
+	return h.LastSnapshotSize, nil
+}
+
+// RecordSnapshotSize persists size as the last successful snapshot size at path.
+func RecordSnapshotSize(path string, size int64) error {
+	b, err := json.Marshal(history{LastSnapshotSize: size})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// CheckFreeSpace refuses to proceed unless dir has at least
+// lastSnapshotSize*safetyFactor bytes of free space available. If
+// lastSnapshotSize is 0 (no history yet), the check is skipped.
+func CheckFreeSpace(dir string, lastSnapshotSize int64, safetyFactor float64) error {
+	if lastSnapshotSize == 0 {
+		logger.Infow("no snapshot history yet, skipping free space check", "dir", dir)
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return xerrors.Errorf("failed to statfs %s: %w", dir, err)
+	}
+
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	required := int64(float64(lastSnapshotSize) * safetyFactor)
+
+	if free < required {
+		return xerrors.Errorf("insufficient free space in %s: have %d bytes, need %d bytes (%.1fx last snapshot size of %d bytes)", dir, free, required, safetyFactor, lastSnapshotSize)
+	}
+
+	logger.Infow("free space check passed", "dir", dir, "free", free, "required", required)
+	return nil
+}
+
+// CheckBucket confirms the credentials, region, and write permissions
+// configured for bucket are usable by checking it exists and round-tripping
+// a zero-byte canary object.
+func CheckBucket(ctx context.Context, minioClient *minio.Client, bucket string) error {
+	ok, err := minioClient.BucketExists(ctx, bucket)
+	if err != nil {
+		return xerrors.Errorf("failed to check bucket exists: %w", err)
+	}
+	if !ok {
+		return xerrors.Errorf("bucket %q does not exist", bucket)
+	}
+
+	const canaryKey = ".fca-preflight-canary"
+
+	if _, err := minioClient.PutObject(ctx, bucket, canaryKey, bytes.NewReader(nil), 0, minio.PutObjectOptions{}); err != nil {
+		return xerrors.Errorf("failed to write canary object: %w", err)
+	}
+
+	if err := minioClient.RemoveObject(ctx, bucket, canaryKey, minio.RemoveObjectOptions{}); err != nil {
+		return xerrors.Errorf("failed to remove canary object: %w", err)
+	}
+
+	logger.Infow("bucket check passed", "bucket", bucket)
+	return nil
+}
+
+// VerifyObject re-downloads bucket/key in parallel range requests, feeding
+// each part into a running sha256 hash as soon as it downloads (rather than
+// buffering the whole object), and compares the result against
+// expectedDigest. It is used after upload to confirm the object landed
+// intact before it is advertised as the latest snapshot. sse must match the
+// encryption the object was uploaded with: SSE-C requires the same customer
+// key on every GET, not just the original PUT.
+func VerifyObject(ctx context.Context, minioClient *minio.Client, bucket, key, expectedDigest string, partSize int64, concurrency int, sse encrypt.ServerSide) error {
+	stat, err := minioClient.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: sse})
+	if err != nil {
+		return xerrors.Errorf("failed to stat object for verification: %w", err)
+	}
+
+	numParts := int((stat.Size + partSize - 1) / partSize)
+	if numParts == 0 {
+		numParts = 1
+	}
+
+	h := sha256.New()
+
+	// Parts can complete out of order, but the digest must be computed over
+	// them in order. pending holds only the parts that finished ahead of
+	// their turn, so memory stays bounded by concurrency rather than by the
+	// full object size.
+	sem := make(chan struct{}, concurrency)
+	var mu sync.Mutex
+	pending := make(map[int][]byte)
+	next := 0
+	flush := func() {
+		for {
+			data, ok := pending[next]
+			if !ok {
+				return
+			}
+			h.Write(data)
+			delete(pending, next)
+			next++
+			// Frees the slot this part took in the loop below.
+			<-sem
+		}
+	}
+
+	g, ctxGroup := errgroup.WithContext(ctx)
+
+	for i := 0; i < numParts; i++ {
+		i := i
+		start := int64(i) * partSize
+		end := start + partSize - 1
+		if end >= stat.Size {
+			end = stat.Size - 1
+		}
+
+		sem <- struct{}{}
+		g.Go(func() (err error) {
+			// The slot is released by flush once this part has been hashed,
+			// or here if it fails.
+			defer func() {
+				if err != nil {
+					<-sem
+				}
+			}()
+
+			opts := minio.GetObjectOptions{ServerSideEncryption: sse}
+			if err := opts.SetRange(start, end); err != nil {
+				return err
+			}
+
+			obj, err := minioClient.GetObject(ctxGroup, bucket, key, opts)
+			if err != nil {
+				return err
+			}
+			defer obj.Close()
+
+			data, err := io.ReadAll(obj)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			pending[i] = data
+			flush()
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return xerrors.Errorf("failed to download object for verification: %w", err)
+	}
+
+	digest := fmt.Sprintf("%x", h.Sum(nil))
+	if digest != expectedDigest {
+		return xerrors.Errorf("digest mismatch for %s: expected %s, got %s", key, expectedDigest, digest)
+	}
+
+	logger.Infow("object verification passed", "bucket", bucket, "key", key, "digest", digest)
+	return nil
+}
@@ -0,0 +1,237 @@
+// Package upload implements a resumable multipart upload pipeline on top of
+// minio-go's core API, so a transient network error partway through a
+// multi-hundred-gigabyte upload does not force starting over from scratch.
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+var logger = logging.Logger("upload")
+
+// Options configures a resumable multipart upload.
+type Options struct {
+	// PartSize is the size in bytes of each part. Every part but the last is exactly this size.
+	PartSize int64
+	// Concurrency is the number of parts uploaded at once.
+	Concurrency int
+	// StateDir is the directory in which upload progress is persisted, keyed by StateKey.
+	StateDir string
+	// StateKey identifies this upload across retries, e.g. "{height}-{peerID}-{codec}".
+	StateKey string
+	// Deadline, if non-zero, aborts the upload if it has not completed by this time.
+	Deadline time.Time
+	// PutOptions is passed to NewMultipartUpload, carrying content type, tags, encryption, etc.
+	PutOptions minio.PutObjectOptions
+}
+
+// Result describes a completed multipart upload.
+type Result struct {
+	ETag string
+	Size int64
+}
+
+type partETag struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+type state struct {
+	Bucket   string     `json:"bucket"`
+	Key      string     `json:"key"`
+	UploadID string     `json:"upload_id"`
+	Parts    []partETag `json:"parts"`
+}
+
+func statePath(dir, key string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.upload.json", key))
+}
+
+func loadState(dir, key string) (*state, error) {
+	b, err := os.ReadFile(statePath(dir, key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var st state
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (st *state) save(dir, key string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(dir, key), b, 0o644)
+}
+
+func removeState(dir, key string) {
+	if err := os.Remove(statePath(dir, key)); err != nil && !os.IsNotExist(err) {
+		logger.Errorw("failed to remove upload state file", "path", statePath(dir, key), "err", err)
+	}
+}
+
+// Upload streams source to bucket/key using a resumable multipart upload. If
+// a state file for opts.StateKey already exists, already-uploaded parts are
+// skipped by consulting ListObjectParts; otherwise a new multipart upload is
+// started. Progress is persisted after every completed part.
+func Upload(ctx context.Context, core *minio.Core, bucket, key string, source io.Reader, opts Options) (*Result, error) {
+	if !opts.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, opts.Deadline)
+		defer cancel()
+	}
+
+	st, err := loadState(opts.StateDir, opts.StateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load upload state: %w", err)
+	}
+
+	done := map[int]partETag{}
+
+	if st != nil && st.Bucket == bucket && st.Key == key {
+		result, err := core.ListObjectParts(ctx, bucket, key, st.UploadID, 0, 10000)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to list existing parts for resumed upload: %w", err)
+		}
+		for _, p := range result.ObjectParts {
+			done[p.PartNumber] = partETag{PartNumber: p.PartNumber, ETag: p.ETag}
+		}
+		// st.Parts is about to be rebuilt from done plus whatever uploads
+		// succeed below; keeping the parts loaded from the state file here
+		// would duplicate every already-completed part number.
+		st.Parts = nil
+		logger.Infow("resuming multipart upload", "bucket", bucket, "key", key, "upload_id", st.UploadID, "parts_done", len(done))
+	} else {
+		uploadID, err := core.NewMultipartUpload(ctx, bucket, key, opts.PutOptions)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to start multipart upload: %w", err)
+		}
+		st = &state{Bucket: bucket, Key: key, UploadID: uploadID}
+		if err := st.save(opts.StateDir, opts.StateKey); err != nil {
+			logger.Errorw("failed to persist upload state", "err", err)
+		}
+	}
+
+	g, ctxGroup := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, opts.Concurrency)
+	var mu sync.Mutex
+	var totalSize int64
+
+	partNumber := 0
+	buf := make([]byte, opts.PartSize)
+	for {
+		partNumber++
+
+		n, readErr := io.ReadFull(source, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return nil, readErr
+		}
+		if n == 0 {
+			break
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		totalSize += int64(n)
+
+		pn := partNumber
+		if existing, ok := done[pn]; ok {
+			mu.Lock()
+			st.Parts = append(st.Parts, existing)
+			mu.Unlock()
+		} else {
+			sem <- struct{}{}
+			g.Go(func() error {
+				defer func() { <-sem }()
+
+				etag, err := uploadPartWithRetry(ctxGroup, core, bucket, key, st.UploadID, pn, data, opts.PutOptions.ServerSideEncryption)
+				if err != nil {
+					return xerrors.Errorf("part %d: %w", pn, err)
+				}
+
+				mu.Lock()
+				st.Parts = append(st.Parts, partETag{PartNumber: pn, ETag: etag})
+				if err := st.save(opts.StateDir, opts.StateKey); err != nil {
+					logger.Errorw("failed to persist upload state", "err", err)
+				}
+				mu.Unlock()
+				return nil
+			})
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	parts := make([]minio.CompletePart, 0, len(st.Parts))
+	for _, p := range st.Parts {
+		parts = append(parts, minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+	info, err := core.CompleteMultipartUpload(ctx, bucket, key, st.UploadID, parts, minio.PutObjectOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	removeState(opts.StateDir, opts.StateKey)
+
+	return &Result{ETag: info.ETag, Size: totalSize}, nil
+}
+
+// uploadPartWithRetry uploads a single part, retrying with exponential
+// backoff and jitter on transient errors. sse must match the encryption
+// configured on the multipart upload: SSE-C requires the same customer key on
+// every part-level request, not just NewMultipartUpload.
+func uploadPartWithRetry(ctx context.Context, core *minio.Core, bucket, key, uploadID string, partNumber int, data []byte, sse encrypt.ServerSide) (string, error) {
+	const maxAttempts = 5
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+			jitter := time.Duration(rand.Int63n(int64(backoff)))
+			select {
+			case <-time.After(backoff + jitter):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		part, err := core.PutObjectPart(ctx, bucket, key, uploadID, partNumber, bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{SSE: sse})
+		if err == nil {
+			return part.ETag, nil
+		}
+		lastErr = err
+		logger.Warnw("part upload failed, will retry", "part", partNumber, "attempt", attempt+1, "err", err)
+	}
+
+	return "", fmt.Errorf("failed after %d attempts: %w", maxAttempts, lastErr)
+}
@@ -0,0 +1,231 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestStatePath(t *testing.T) {
+	cases := []struct {
+		dir  string
+		key  string
+		want string
+	}{
+		{dir: "/tmp/state", key: "100-Qm123-zstd", want: "/tmp/state/100-Qm123-zstd.upload.json"},
+		{dir: "state", key: "a", want: "state/a.upload.json"},
+	}
+
+	for _, c := range cases {
+		if got := statePath(c.dir, c.key); got != c.want {
+			t.Errorf("statePath(%q, %q) = %q, want %q", c.dir, c.key, got, c.want)
+		}
+	}
+}
+
+func TestLoadStateMissingFileReturnsNil(t *testing.T) {
+	st, err := loadState(t.TempDir(), "does-not-exist")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st != nil {
+		t.Fatalf("expected nil state, got %+v", st)
+	}
+}
+
+func TestSaveLoadStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	key := "100-Qm123-zstd"
+
+	want := &state{
+		Bucket:   "bucket",
+		Key:      "object.zst",
+		UploadID: "upload-id",
+		Parts: []partETag{
+			{PartNumber: 1, ETag: "etag-1"},
+			{PartNumber: 2, ETag: "etag-2"},
+		},
+	}
+
+	if err := want.save(dir, key); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	if _, err := os.Stat(statePath(dir, key)); err != nil {
+		t.Fatalf("expected state file to exist: %v", err)
+	}
+
+	got, err := loadState(dir, key)
+	if err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+
+	if got.Bucket != want.Bucket || got.Key != want.Key || got.UploadID != want.UploadID {
+		t.Fatalf("loadState() = %+v, want %+v", got, want)
+	}
+	if len(got.Parts) != len(want.Parts) {
+		t.Fatalf("loadState() parts = %+v, want %+v", got.Parts, want.Parts)
+	}
+	for i := range want.Parts {
+		if got.Parts[i] != want.Parts[i] {
+			t.Errorf("part %d = %+v, want %+v", i, got.Parts[i], want.Parts[i])
+		}
+	}
+}
+
+func TestRemoveStateIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	key := "key"
+
+	st := &state{Bucket: "b", Key: "k", UploadID: "u"}
+	if err := st.save(dir, key); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	removeState(dir, key)
+	if _, err := os.Stat(statePath(dir, key)); !os.IsNotExist(err) {
+		t.Fatalf("expected state file to be removed, stat err = %v", err)
+	}
+
+	// Removing again, with no file present, must not panic or error out loud.
+	removeState(dir, key)
+}
+
+func TestStatePathIsScopedToDir(t *testing.T) {
+	dirA := filepath.Join(t.TempDir(), "a")
+	dirB := filepath.Join(t.TempDir(), "b")
+
+	if statePath(dirA, "key") == statePath(dirB, "key") {
+		t.Fatalf("expected state paths in different dirs to differ")
+	}
+}
+
+// fakeS3Parts is a minimal handler for the ListObjectParts and
+// CompleteMultipartUpload calls a resumed upload makes, with no
+// PutObjectPart handling: every part in the test is already reported as
+// done by ListObjectParts, so Upload has nothing left to upload.
+func fakeS3Parts(t *testing.T, parts []partETag, completeBody *[]byte) *httptest.Server {
+	t.Helper()
+
+	var partsXML strings.Builder
+	for _, p := range parts {
+		fmt.Fprintf(&partsXML, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>4</Size></Part>", p.PartNumber, p.ETag)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodGet && q.Has("uploadId"):
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListPartsResult><Bucket>test-bucket</Bucket><Key>test-key</Key><UploadId>test-upload-id</UploadId><IsTruncated>false</IsTruncated>%s</ListPartsResult>`, partsXML.String())
+		case r.Method == http.MethodPost && q.Has("uploadId"):
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("reading CompleteMultipartUpload body: %v", err)
+			}
+			*completeBody = b
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<CompleteMultipartUploadResult><Location>http://example.com/test-bucket/test-key</Location><Bucket>test-bucket</Bucket><Key>test-key</Key><ETag>"final-etag"</ETag></CompleteMultipartUploadResult>`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+}
+
+// TestUploadResumeDoesNotDuplicateCompletedParts guards against a bug where
+// resuming an upload re-appended every part ListObjectParts reported as done
+// onto the parts already persisted in the state file from before the
+// restart, so CompleteMultipartUpload was sent duplicate PartNumbers for
+// every already-completed part.
+func TestUploadResumeDoesNotDuplicateCompletedParts(t *testing.T) {
+	const bucket = "test-bucket"
+	const key = "test-key"
+	const uploadID = "test-upload-id"
+
+	doneParts := []partETag{
+		{PartNumber: 1, ETag: `"etag-1"`},
+		{PartNumber: 2, ETag: `"etag-2"`},
+	}
+
+	var completeBody []byte
+	srv := fakeS3Parts(t, doneParts, &completeBody)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parse test server url: %v", err)
+	}
+
+	minioClient, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Secure: false,
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("minio.New: %v", err)
+	}
+	core := &minio.Core{Client: minioClient}
+
+	dir := t.TempDir()
+	stateKey := "100-peer-zstd"
+
+	// Seed the state file as it would look after a previous, interrupted run:
+	// parts 1 and 2 already persisted, same as what ListObjectParts reports.
+	seeded := &state{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+		Parts:    append([]partETag{}, doneParts...),
+	}
+	if err := seeded.save(dir, stateKey); err != nil {
+		t.Fatalf("seed state: %v", err)
+	}
+
+	source := bytes.NewReader([]byte("aaaabbbb")) // exactly two 4-byte parts
+
+	if _, err := Upload(context.Background(), core, bucket, key, source, Options{
+		PartSize:    4,
+		Concurrency: 2,
+		StateDir:    dir,
+		StateKey:    stateKey,
+	}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	if completeBody == nil {
+		t.Fatal("CompleteMultipartUpload was never called")
+	}
+
+	var req struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(completeBody, &req); err != nil {
+		t.Fatalf("unmarshal CompleteMultipartUpload body: %v\nbody: %s", err, completeBody)
+	}
+
+	if len(req.Part) != len(doneParts) {
+		t.Fatalf("CompleteMultipartUpload got %d parts, want %d (deduplicated): %+v", len(req.Part), len(doneParts), req.Part)
+	}
+	for i, want := range doneParts {
+		if req.Part[i].PartNumber != want.PartNumber {
+			t.Errorf("part %d: PartNumber = %d, want %d (parts must be ascending and deduplicated)", i, req.Part[i].PartNumber, want.PartNumber)
+		}
+	}
+}